@@ -4,19 +4,25 @@
 package bootstrap
 
 import (
+	"compress/gzip"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"net/url"
 	"os"
 	"strings"
 
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/mainflux/agent/pkg/agent"
+	bscrypto "github.com/mainflux/agent/pkg/bootstrap/crypto"
 
 	export "github.com/mainflux/export/pkg/config"
 	errors "github.com/mainflux/mainflux/errors"
@@ -26,6 +32,15 @@ import (
 
 const exportConfigFile = "/configs/export/config.toml"
 
+// Default retry parameters, used when the corresponding Config fields are
+// left unset so that existing deployments keep their current behavior.
+const (
+	defaultRetryInitialMs  = 500
+	defaultRetryMaxMs      = 10000
+	defaultRetryJitter     = 0.2
+	defaultRetryMaxElapsed = 0 // no overall budget, bounded by Retries instead
+)
+
 // Config represents the parameters for boostraping
 type Config struct {
 	URL           string
@@ -33,8 +48,99 @@ type Config struct {
 	Key           string
 	Retries       string
 	RetryDelaySec string
-	Encrypt       string
-	SkipTLS       bool
+	// Encrypt holds the pre-shared key, inline, used to decrypt or verify an
+	// encrypted deviceConfig blob. See also EncryptKeyFile.
+	Encrypt string
+	SkipTLS bool
+
+	// RetryInitialMs is the delay before the first retry, in milliseconds.
+	// Defaults to RetryDelaySec*1000 when unset.
+	RetryInitialMs string
+	// RetryMaxMs caps the computed backoff delay, in milliseconds.
+	RetryMaxMs string
+	// RetryMaxElapsedSec bounds the total time spent retrying. Zero (the
+	// default) leaves Retries as the only bound.
+	RetryMaxElapsedSec string
+	// RetryJitter is the +/- fraction of randomness applied to each delay.
+	RetryJitter string
+
+	// ClientCertFile and ClientKeyFile, when both set, are presented to the
+	// bootstrap server for mutual TLS.
+	ClientCertFile string
+	ClientKeyFile  string
+	// ServerCAFile, when set, is appended to the system root pool used to
+	// verify the bootstrap server's certificate.
+	ServerCAFile string
+	// ProxyURL, when set, overrides http.ProxyFromEnvironment for the
+	// bootstrap HTTP client.
+	ProxyURL string
+	// Timeout bounds a single bootstrap HTTP request, e.g. "10s". Left
+	// unset, the client has no request timeout.
+	Timeout string
+
+	// EncryptKeyFile, when set, is read for the pre-shared key used to
+	// decrypt or verify an encrypted deviceConfig blob, taking precedence
+	// over the inline Encrypt value.
+	EncryptKeyFile string
+}
+
+// retryPolicyFromConfig builds a retryPolicy from cfg, deriving
+// backward-compatible defaults from Retries/RetryDelaySec when the newer
+// fields are left unset.
+func retryPolicyFromConfig(cfg Config, retryDelaySec uint64) retryPolicy {
+	initial := time.Duration(defaultRetryInitialMs) * time.Millisecond
+	if retryDelaySec > 0 {
+		initial = time.Duration(retryDelaySec) * time.Second
+	}
+	if ms, err := strconv.ParseUint(cfg.RetryInitialMs, 10, 64); err == nil && ms > 0 {
+		initial = time.Duration(ms) * time.Millisecond
+	}
+
+	max := initial
+	if d := time.Duration(defaultRetryMaxMs) * time.Millisecond; d > max {
+		max = d
+	}
+	if ms, err := strconv.ParseUint(cfg.RetryMaxMs, 10, 64); err == nil && ms > 0 {
+		max = time.Duration(ms) * time.Millisecond
+	}
+
+	jitter := defaultRetryJitter
+	if j, err := strconv.ParseFloat(cfg.RetryJitter, 64); err == nil && j >= 0 {
+		jitter = j
+	}
+
+	maxElapsed := time.Duration(defaultRetryMaxElapsed) * time.Second
+	if s, err := strconv.ParseUint(cfg.RetryMaxElapsedSec, 10, 64); err == nil && s > 0 {
+		maxElapsed = time.Duration(s) * time.Second
+	}
+
+	return retryPolicy{initial: initial, max: max, jitter: jitter, maxElapsed: maxElapsed}
+}
+
+// statusError wraps a non-2xx bootstrap server response, optionally carrying
+// a server-requested Retry-After override for the next backoff delay.
+type statusError struct {
+	status     int
+	retryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return http.StatusText(e.status)
+}
+
+// retryAfterFromHeader parses an RFC 7231 Retry-After header that gives a
+// delay in seconds. A zero duration is returned if the header is absent or
+// not in the numeric-seconds form.
+func retryAfterFromHeader(h http.Header) time.Duration {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	secs, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
 }
 
 type ServicesConfig struct {
@@ -61,46 +167,126 @@ type infraConfig struct {
 	ExportConfig export.Config `json:"export_config"`
 }
 
-// Bootstrap - Retrieve device config
-func Bootstrap(cfg Config, logger log.Logger, file string) error {
-	retries, err := strconv.ParseUint(cfg.Retries, 10, 64)
+// ErrSkipped is returned by Fetch when bootstrapping is disabled (Retries is
+// 0) or the configured retries are exhausted without a successful response.
+// It signals that the caller should continue with the local/environment
+// configuration rather than treat the bootstrap as failed.
+var ErrSkipped = errors.New("bootstrap skipped, continuing with local config")
+
+// Bootstrapper retrieves device configuration from a bootstrap service and
+// persists it locally.
+type Bootstrapper interface {
+	// Fetch retrieves the device config, retrying per the configured retry
+	// policy until a response is obtained, ctx is cancelled, or the retries
+	// are exhausted. It returns ErrSkipped, rather than an error, when
+	// bootstrapping is disabled or exhausted without success.
+	Fetch(ctx context.Context) (ServicesConfig, error)
+
+	// Persist writes sc to the agent config file and, if it is not already
+	// present, the bundled export config file.
+	Persist(sc ServicesConfig) error
+}
+
+// httpBootstrapper is the Bootstrapper backed by the bootstrap HTTP API.
+type httpBootstrapper struct {
+	cfg    Config
+	logger log.Logger
+	file   string
+	client *http.Client
+}
+
+// NewBootstrapper returns a Bootstrapper that fetches device config over
+// HTTP(S) as configured by cfg, persisting it under file.
+func NewBootstrapper(cfg Config, logger log.Logger, file string) (Bootstrapper, error) {
+	client, err := newHTTPClient(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &httpBootstrapper{cfg: cfg, logger: logger, file: file, client: client}, nil
+}
+
+// Bootstrap retrieves the device config and persists it, or returns nil
+// without persisting anything if bootstrapping is disabled or exhausted.
+// It is a convenience wrapper around NewBootstrapper, Fetch and Persist for
+// callers that don't need finer-grained control over the two steps.
+func Bootstrap(ctx context.Context, cfg Config, logger log.Logger, file string) error {
+	b, err := NewBootstrapper(cfg, logger, file)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Invalid BOOTSTRAP_RETRIES value: %s", err))
+		return err
+	}
+
+	sc, err := b.Fetch(ctx)
+	if err != nil {
+		if err == ErrSkipped {
+			return nil
+		}
+		return err
+	}
+
+	return b.Persist(sc)
+}
+
+func (b *httpBootstrapper) Fetch(ctx context.Context) (ServicesConfig, error) {
+	retries, err := strconv.ParseUint(b.cfg.Retries, 10, 64)
+	if err != nil {
+		return ServicesConfig{}, errors.New(fmt.Sprintf("Invalid BOOTSTRAP_RETRIES value: %s", err))
 	}
 
 	if retries == 0 {
-		logger.Info("No bootstraping, environment variables will be used")
-		return nil
+		b.logger.Info("No bootstraping, environment variables will be used")
+		return ServicesConfig{}, ErrSkipped
 	}
 
-	retryDelaySec, err := strconv.ParseUint(cfg.RetryDelaySec, 10, 64)
+	retryDelaySec, err := strconv.ParseUint(b.cfg.RetryDelaySec, 10, 64)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Invalid BOOTSTRAP_RETRY_DELAY_SECONDS value: %s", err))
+		return ServicesConfig{}, errors.New(fmt.Sprintf("Invalid BOOTSTRAP_RETRY_DELAY_SECONDS value: %s", err))
 	}
 
-	logger.Info(fmt.Sprintf("Requesting config for %s from %s", cfg.ID, cfg.URL))
+	policy := retryPolicyFromConfig(b.cfg, retryDelaySec)
+
+	b.logger.Info(fmt.Sprintf("Requesting config for %s from %s", b.cfg.ID, b.cfg.URL))
 
 	dc := deviceConfig{}
+	start := time.Now()
 
 	for i := 0; i < int(retries); i++ {
-		dc, err = getConfig(cfg.ID, cfg.Key, cfg.URL, cfg.SkipTLS, logger)
+		dc, _, err = getConfig(ctx, b.cfg, b.client)
 		if err == nil {
 			break
 		}
-		logger.Error(fmt.Sprintf("Fetching bootstrap failed with error: %s", err))
-		logger.Debug(fmt.Sprintf("Retries remaining: %d. Retrying in %d seconds", retries, retryDelaySec))
-		time.Sleep(time.Duration(retryDelaySec) * time.Second)
-		if i == int(retries)-1 {
-			logger.Warn("Retries exhausted")
-			logger.Info(fmt.Sprintf("Continuing with local config"))
-			return nil
+		b.logger.Error(fmt.Sprintf("Fetching bootstrap failed with error: %s", err))
+
+		if i == int(retries)-1 || policy.elapsedExceeded(start) {
+			b.logger.Warn("Retries exhausted")
+			b.logger.Info(fmt.Sprintf("Continuing with local config"))
+			return ServicesConfig{}, ErrSkipped
+		}
+
+		delay := policy.next(i)
+		if se, ok := err.(*statusError); ok && se.retryAfter > 0 {
+			delay = se.retryAfter
+		}
+		b.logger.Debug(fmt.Sprintf("Retries remaining: %d. Retrying in %s", retries-uint64(i)-1, delay))
+		if err := sleep(ctx, delay); err != nil {
+			b.logger.Warn("Bootstrap cancelled while waiting to retry")
+			return ServicesConfig{}, err
 		}
 	}
 
-	saveExportConfig(dc.Content.Export, logger)
+	return buildServicesConfig(dc, b.file)
+}
 
+func (b *httpBootstrapper) Persist(sc ServicesConfig) error {
+	saveExportConfig(context.Background(), sc.Export, b.logger)
+	return agent.SaveConfig(sc.Agent)
+}
+
+// buildServicesConfig merges the channel and credential fields carried on
+// dc outside of Content into dc.Content.Agent, producing the final
+// ServicesConfig ready to persist or diff against a previously fetched one.
+func buildServicesConfig(dc deviceConfig, file string) (ServicesConfig, error) {
 	if len(dc.MainfluxChannels) < 2 {
-		return agent.ErrMalformedEntity
+		return ServicesConfig{}, agent.ErrMalformedEntity
 	}
 
 	ctrlChan := dc.MainfluxChannels[0].ID
@@ -129,10 +315,15 @@ func Bootstrap(cfg Config, logger log.Logger, file string) error {
 	tc := dc.Content.Agent.Terminal
 	c := agent.NewConfig(sc, cc, ec, lc, mc, hc, tc, file)
 
-	return agent.SaveConfig(c)
+	return ServicesConfig{Agent: c, Export: dc.Content.Export}, nil
 }
 
-func saveExportConfig(econf export.Config, logger log.Logger) {
+// saveExportConfig writes econf to its configured file, unless that file
+// already exists or ctx has been cancelled.
+func saveExportConfig(ctx context.Context, econf export.Config, logger log.Logger) {
+	if ctx.Err() != nil {
+		return
+	}
 	if econf.File == "" {
 		econf.File = exportConfigFile
 	}
@@ -149,7 +340,31 @@ func saveExportConfig(econf export.Config, logger log.Logger) {
 	}
 }
 
-func getConfig(bsID, bsKey, bsSvrURL string, skipTLS bool, logger log.Logger) (deviceConfig, error) {
+// newHTTPClient builds the http.Client used for a single bootstrap request,
+// configuring mutual TLS, a trusted CA and an HTTP proxy from cfg when
+// present, and bounding each request by cfg.Timeout.
+func newHTTPClient(cfg Config, logger log.Logger) (*http.Client, error) {
+	client, err := newHTTPClientTransport(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Timeout != "" {
+		timeout, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid Timeout value: %s", err))
+		}
+		client.Timeout = timeout
+	}
+	return client, nil
+}
+
+// newHTTPClientTransport builds the http.Client used to reach the bootstrap
+// server, configuring mutual TLS, a trusted CA and an HTTP proxy from cfg
+// when present, but leaving client.Timeout unset. cfg.Timeout bounds a
+// single request-response round trip and is unsuitable for a long-poll,
+// whose wait window is typically much longer; newHTTPClient applies it,
+// the Watcher does not.
+func newHTTPClientTransport(cfg Config, logger log.Logger) (*http.Client, error) {
 	// Get the SystemCertPool, continue with an empty pool on error
 	rootCAs, err := x509.SystemCertPool()
 	if err != nil {
@@ -158,43 +373,153 @@ func getConfig(bsID, bsKey, bsSvrURL string, skipTLS bool, logger log.Logger) (d
 	if rootCAs == nil {
 		rootCAs = x509.NewCertPool()
 	}
+	if cfg.ServerCAFile != "" {
+		ca, err := ioutil.ReadFile(cfg.ServerCAFile)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to read ServerCAFile: %s", err))
+		}
+		if !rootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New(fmt.Sprintf("Failed to append certificates from %s", cfg.ServerCAFile))
+		}
+	}
+
 	// Trust the augmented cert pool in our client
-	config := &tls.Config{
-		InsecureSkipVerify: skipTLS,
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.SkipTLS,
 		RootCAs:            rootCAs,
 	}
-	tr := &http.Transport{TLSClientConfig: config}
-	client := &http.Client{Transport: tr}
-	url := fmt.Sprintf("%s/%s", bsSvrURL, bsID)
+	if cfg.ClientCertFile != "" && cfg.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCertFile, cfg.ClientKeyFile)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to load client keypair: %s", err))
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	proxy := http.ProxyFromEnvironment
+	if cfg.ProxyURL != "" {
+		proxyURL, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid ProxyURL: %s", err))
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	tr := &http.Transport{TLSClientConfig: tlsConfig, Proxy: proxy}
+	return &http.Client{Transport: tr}, nil
+}
+
+// getConfig fetches the device config once, returning the ETag the
+// bootstrap server attached to it, if any, for use as the version in a
+// later Watcher long-poll.
+func getConfig(ctx context.Context, cfg Config, client *http.Client) (deviceConfig, string, error) {
+	reqURL := fmt.Sprintf("%s/%s", cfg.URL, cfg.ID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
 	if err != nil {
-		return deviceConfig{}, err
+		return deviceConfig{}, "", err
 	}
 
-	req.Header.Add("Authorization", bsKey)
+	setBootstrapHeaders(req, cfg)
 	resp, err := client.Do(req)
 	if err != nil {
-		return deviceConfig{}, err
+		return deviceConfig{}, "", err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode >= http.StatusBadRequest {
-		return deviceConfig{}, errors.New(http.StatusText(resp.StatusCode))
+		return deviceConfig{}, "", &statusError{status: resp.StatusCode, retryAfter: retryAfterFromHeader(resp.Header)}
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	dc, err := parseConfigResponse(cfg, resp)
+	if err != nil {
+		return deviceConfig{}, "", err
+	}
+	return dc, resp.Header.Get("ETag"), nil
+}
+
+// setBootstrapHeaders adds the Authorization and content-negotiation
+// headers common to every request against the bootstrap server.
+func setBootstrapHeaders(req *http.Request, cfg Config) {
+	req.Header.Add("Authorization", cfg.Key)
+	req.Header.Add("Accept-Encoding", "gzip")
+	if supported := bscrypto.Supported(); len(supported) > 0 {
+		req.Header.Add("Accept-Encryption", strings.Join(supported, ","))
+	}
+}
+
+// parseConfigResponse decodes a successful bootstrap response body, undoing
+// gzip compression and any encryption or signing before unmarshaling it
+// into a deviceConfig.
+func parseConfigResponse(cfg Config, resp *http.Response) (deviceConfig, error) {
+	reader := io.Reader(resp.Body)
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return deviceConfig{}, err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	body, err := ioutil.ReadAll(reader)
 	if err != nil {
 		return deviceConfig{}, err
 	}
-	defer resp.Body.Close()
+
+	body, err = decodeProtectedBody(cfg, resp.Header, body)
+	if err != nil {
+		return deviceConfig{}, err
+	}
+
 	dc := deviceConfig{}
 	b := convertContentStringToJSON(body)
-	fmt.Printf("%v\n", string(b))
 	if err := json.Unmarshal([]byte(b), &dc); err != nil {
 		return deviceConfig{}, err
 	}
 	return dc, nil
 }
 
+// loadEncryptKey resolves the pre-shared key used to decrypt or verify a
+// protected deviceConfig blob, preferring EncryptKeyFile over the inline
+// Encrypt value.
+func loadEncryptKey(cfg Config) ([]byte, error) {
+	if cfg.EncryptKeyFile != "" {
+		return ioutil.ReadFile(cfg.EncryptKeyFile)
+	}
+	return []byte(cfg.Encrypt), nil
+}
+
+// decodeProtectedBody undoes whatever protection the bootstrap server
+// applied to body, as named by the X-Config-Encryption response header. An
+// absent header means the payload was sent as-is. An unknown algorithm
+// fails closed rather than trusting an unprotected payload.
+func decodeProtectedBody(cfg Config, header http.Header, body []byte) ([]byte, error) {
+	alg := header.Get("X-Config-Encryption")
+	if alg == "" {
+		return body, nil
+	}
+
+	key, err := loadEncryptKey(cfg)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to load encryption key: %s", err))
+	}
+
+	if d, ok := bscrypto.GetDecryptor(alg); ok {
+		return d.Decrypt(body, key)
+	}
+	if v, ok := bscrypto.GetVerifier(alg); ok {
+		sig, err := base64.StdEncoding.DecodeString(header.Get("X-Config-Signature"))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid X-Config-Signature header: %s", err))
+		}
+		if err := v.Verify(body, sig, key); err != nil {
+			return nil, err
+		}
+		return body, nil
+	}
+	return nil, bscrypto.ErrUnsupportedAlgorithm{Name: alg}
+}
+
 func convertContentStringToJSON(bin []byte) []byte {
 	b := strings.ReplaceAll(string(bin), "\\", "")
 	b = strings.ReplaceAll(string(b), "\"{", "{")
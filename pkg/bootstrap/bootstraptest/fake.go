@@ -0,0 +1,46 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+// Package bootstraptest provides a fake bootstrap.Bootstrapper for testing
+// code that depends on one, without exercising the real HTTP client.
+package bootstraptest
+
+import (
+	"context"
+
+	"github.com/mainflux/agent/pkg/bootstrap"
+)
+
+// FakeBootstrapper is a bootstrap.Bootstrapper whose Fetch and Persist
+// results are configured directly by the test, and which records every
+// config passed to Persist for later assertions.
+type FakeBootstrapper struct {
+	FetchConfig bootstrap.ServicesConfig
+	FetchErr    error
+	PersistErr  error
+	Persisted   []bootstrap.ServicesConfig
+}
+
+// NewFakeBootstrapper returns a FakeBootstrapper whose Fetch returns cfg
+// and err.
+func NewFakeBootstrapper(cfg bootstrap.ServicesConfig, err error) *FakeBootstrapper {
+	return &FakeBootstrapper{FetchConfig: cfg, FetchErr: err}
+}
+
+// Fetch returns f.FetchConfig and f.FetchErr, or ctx.Err() if ctx has
+// already been cancelled.
+func (f *FakeBootstrapper) Fetch(ctx context.Context) (bootstrap.ServicesConfig, error) {
+	if err := ctx.Err(); err != nil {
+		return bootstrap.ServicesConfig{}, err
+	}
+	return f.FetchConfig, f.FetchErr
+}
+
+// Persist appends sc to f.Persisted and returns f.PersistErr.
+func (f *FakeBootstrapper) Persist(sc bootstrap.ServicesConfig) error {
+	if f.PersistErr != nil {
+		return f.PersistErr
+	}
+	f.Persisted = append(f.Persisted, sc)
+	return nil
+}
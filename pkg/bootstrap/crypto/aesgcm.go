@@ -0,0 +1,36 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+)
+
+func init() {
+	RegisterDecryptor(aesGCM{})
+}
+
+// aesGCM decrypts payloads sealed with AES-GCM, where the nonce is prepended
+// to the ciphertext as produced by cipher.AEAD.Seal.
+type aesGCM struct{}
+
+func (aesGCM) Name() string { return "aes-gcm" }
+
+func (aesGCM) Decrypt(ciphertext, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, fmt.Errorf("aes-gcm: ciphertext shorter than nonce")
+	}
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, nil)
+}
@@ -0,0 +1,32 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package crypto
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func init() {
+	RegisterDecryptor(chacha20Poly1305{})
+}
+
+// chacha20Poly1305 decrypts payloads sealed with ChaCha20-Poly1305, where
+// the nonce is prepended to the ciphertext as produced by cipher.AEAD.Seal.
+type chacha20Poly1305 struct{}
+
+func (chacha20Poly1305) Name() string { return "chacha20-poly1305" }
+
+func (chacha20Poly1305) Decrypt(ciphertext, key []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("chacha20-poly1305: ciphertext shorter than nonce")
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, nil)
+}
@@ -0,0 +1,82 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+// Package crypto defines a pluggable registry of algorithms used to protect
+// bootstrap config payloads in transit, so the bootstrap server can encrypt
+// or sign a deviceConfig blob and the agent can undo that locally before the
+// config is ever written to disk.
+package crypto
+
+import "fmt"
+
+// Decryptor decrypts a ciphertext produced by a bootstrap server using a
+// pre-shared key.
+type Decryptor interface {
+	// Name is the algorithm identifier advertised in the Accept-Encryption
+	// request header and echoed back in X-Config-Encryption.
+	Name() string
+	Decrypt(ciphertext, key []byte) ([]byte, error)
+}
+
+// Verifier checks a detached signature over a bootstrap config payload.
+type Verifier interface {
+	// Name is the algorithm identifier advertised in the Accept-Encryption
+	// request header and echoed back in X-Config-Encryption.
+	Name() string
+	Verify(data, sig, key []byte) error
+}
+
+var (
+	decryptors = map[string]Decryptor{}
+	verifiers  = map[string]Verifier{}
+)
+
+// RegisterDecryptor adds d to the registry under d.Name(), overwriting any
+// previous registration with the same name.
+func RegisterDecryptor(d Decryptor) {
+	decryptors[d.Name()] = d
+}
+
+// RegisterVerifier adds v to the registry under v.Name(), overwriting any
+// previous registration with the same name.
+func RegisterVerifier(v Verifier) {
+	verifiers[v.Name()] = v
+}
+
+// Decryptor returns the registered Decryptor for name, or false if name is
+// unknown.
+func GetDecryptor(name string) (Decryptor, bool) {
+	d, ok := decryptors[name]
+	return d, ok
+}
+
+// Verifier returns the registered Verifier for name, or false if name is
+// unknown.
+func GetVerifier(name string) (Verifier, bool) {
+	v, ok := verifiers[name]
+	return v, ok
+}
+
+// Supported lists the names of every registered Decryptor and Verifier, in
+// the form expected by the Accept-Encryption request header.
+func Supported() []string {
+	names := make([]string, 0, len(decryptors)+len(verifiers))
+	for name := range decryptors {
+		names = append(names, name)
+	}
+	for name := range verifiers {
+		names = append(names, name)
+	}
+	return names
+}
+
+// ErrUnsupportedAlgorithm is returned when a bootstrap server names an
+// algorithm that has no registered Decryptor or Verifier, so the agent fails
+// closed instead of trusting an unprotected payload.
+type ErrUnsupportedAlgorithm struct {
+	Name string
+}
+
+func (e ErrUnsupportedAlgorithm) Error() string {
+	return fmt.Sprintf("unsupported config encryption algorithm: %s", e.Name)
+}
@@ -0,0 +1,29 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package crypto
+
+import (
+	"crypto/ed25519"
+	"fmt"
+)
+
+func init() {
+	RegisterVerifier(ed25519Verifier{})
+}
+
+// ed25519Verifier verifies a detached Ed25519 signature over the bootstrap
+// config payload using the device's configured public key.
+type ed25519Verifier struct{}
+
+func (ed25519Verifier) Name() string { return "ed25519" }
+
+func (ed25519Verifier) Verify(data, sig, key []byte) error {
+	if len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("ed25519: invalid public key size %d", len(key))
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), data, sig) {
+		return fmt.Errorf("ed25519: signature verification failed")
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package bootstrap
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// retryPolicy computes exponential backoff delays with jitter, bounded by
+// a per-attempt maximum, in the same shape as OTLP's retry policy:
+// delay = min(max, initial*2^attempt) * (1 +/- jitter).
+type retryPolicy struct {
+	initial    time.Duration
+	max        time.Duration
+	maxElapsed time.Duration
+	jitter     float64
+}
+
+// next returns the delay to wait before the given (0-indexed) attempt.
+func (p retryPolicy) next(attempt int) time.Duration {
+	delay := float64(p.initial) * math.Pow(2, float64(attempt))
+	if max := float64(p.max); delay > max {
+		delay = max
+	}
+	if p.jitter > 0 {
+		delta := delay * p.jitter
+		delay = delay - delta + rand.Float64()*2*delta
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return time.Duration(delay)
+}
+
+// elapsedExceeded reports whether running for d since start has used up the
+// retry policy's overall time budget. A zero maxElapsed means no budget.
+func (p retryPolicy) elapsedExceeded(start time.Time) bool {
+	if p.maxElapsed <= 0 {
+		return false
+	}
+	return time.Since(start) >= p.maxElapsed
+}
+
+// sleep waits for d, returning early with ctx.Err() if ctx is cancelled.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright (c) Mainflux
+// SPDX-License-Identifier: Apache-2.0
+
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"time"
+
+	log "github.com/mainflux/mainflux/logger"
+)
+
+// EventType identifies the kind of config change a Watcher has detected.
+type EventType string
+
+const (
+	// ChannelsChanged is emitted when the control or data channel assigned
+	// to the device changes.
+	ChannelsChanged EventType = "channels_changed"
+	// MQTTCredsRotated is emitted when the MQTT username, password or
+	// certificates change.
+	MQTTCredsRotated EventType = "mqtt_creds_rotated"
+	// ExportChanged is emitted when the export config changes.
+	ExportChanged EventType = "export_changed"
+	// HeartbeatChanged is emitted when the heartbeat config changes.
+	HeartbeatChanged EventType = "heartbeat_changed"
+)
+
+// Event describes a single detected change, carrying the full new config so
+// a subscriber can apply it without fetching again.
+type Event struct {
+	Type   EventType
+	Config ServicesConfig
+}
+
+// Watcher long-polls the bootstrap server for changes to a device's config
+// after the initial fetch, emitting a typed Event for every difference it
+// finds between successive responses.
+type Watcher struct {
+	cfg    Config
+	logger log.Logger
+	client *http.Client
+	file   string
+	wait   time.Duration
+	policy retryPolicy
+
+	last    ServicesConfig
+	version string
+	events  chan Event
+	cancel  context.CancelFunc
+	ctx     context.Context
+	done    chan struct{}
+}
+
+// NewWatcher fetches the device config once to establish a baseline, then
+// returns a Watcher that long-polls cfg.URL for changes to cfg.ID, diffing
+// each subsequent response against that baseline and then against its own
+// last-seen config, emitting an Event on Events for every difference. This
+// priming fetch is also where the Watcher obtains the ETag the bootstrap
+// server uses as the long-poll's version, which a plain Fetch has no way to
+// hand it. wait bounds how long each long-poll request blocks server-side
+// before the server returns 304 Not Modified if nothing changed. Transport
+// errors are retried using the same retry policy as Bootstrapper.Fetch.
+func NewWatcher(cfg Config, logger log.Logger, file string, wait time.Duration) (*Watcher, error) {
+	// cfg.Timeout, if set, bounds a single bootstrap request-response round
+	// trip; it is far shorter than a long-poll's wait window, so the
+	// Watcher gets its own client with no request timeout and relies on
+	// ctx (cancelled by Stop) to bound in-flight polls instead.
+	client, err := newHTTPClientTransport(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	dc, version, err := getConfig(ctx, cfg, client)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	last, err := buildServicesConfig(dc, file)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &Watcher{
+		cfg:     cfg,
+		logger:  logger,
+		client:  client,
+		file:    file,
+		wait:    wait,
+		version: version,
+		policy:  retryPolicyFromConfig(cfg, 0),
+		last:    last,
+		events:  make(chan Event),
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// Events returns the channel on which the Watcher emits a typed Event for
+// each config change it detects. The channel is closed once Stop has
+// unblocked the watch loop.
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Watch starts the long-poll loop in its own goroutine. It must be called
+// at most once per Watcher.
+func (w *Watcher) Watch() {
+	go w.run()
+}
+
+// Stop cancels any in-flight long-poll request and waits for the watch
+// loop to return and Events to be closed.
+func (w *Watcher) Stop() {
+	w.cancel()
+	<-w.done
+}
+
+func (w *Watcher) run() {
+	defer close(w.done)
+	defer close(w.events)
+
+	version := w.version
+	attempt := 0
+	start := time.Now()
+
+	for {
+		pollStart := time.Now()
+		dc, etag, notModified, err := pollConfig(w.ctx, w.cfg, w.client, version, w.wait)
+		if err != nil {
+			if w.ctx.Err() != nil {
+				return
+			}
+			w.logger.Error(fmt.Sprintf("Watch poll failed with error: %s", err))
+
+			delay := w.policy.next(attempt)
+			if se, ok := err.(*statusError); ok && se.retryAfter > 0 {
+				delay = se.retryAfter
+			}
+			attempt++
+			if w.policy.elapsedExceeded(start) {
+				attempt = 0
+				start = time.Now()
+			}
+			if err := sleep(w.ctx, delay); err != nil {
+				return
+			}
+			continue
+		}
+		attempt = 0
+		start = time.Now()
+
+		if notModified {
+			// A well-behaved server only answers 304 after holding the
+			// request open for w.wait. One that answers immediately would
+			// otherwise turn this into a busy-spin against the endpoint,
+			// so enforce w.wait as a floor between poll attempts too.
+			if remaining := w.wait - time.Since(pollStart); remaining > 0 {
+				if err := sleep(w.ctx, remaining); err != nil {
+					return
+				}
+			}
+			continue
+		}
+		version = etag
+
+		sc, err := buildServicesConfig(dc, w.file)
+		if err != nil {
+			w.logger.Error(fmt.Sprintf("Discarding malformed watch update: %s", err))
+			continue
+		}
+
+		for _, et := range diffEvents(w.last, sc) {
+			select {
+			case w.events <- Event{Type: et, Config: sc}:
+			case <-w.ctx.Done():
+				return
+			}
+		}
+		w.last = sc
+	}
+}
+
+// diffEvents reports which aspects of sc changed relative to prev.
+func diffEvents(prev, sc ServicesConfig) []EventType {
+	var events []EventType
+	if !reflect.DeepEqual(prev.Agent.Channels, sc.Agent.Channels) {
+		events = append(events, ChannelsChanged)
+	}
+	if !reflect.DeepEqual(prev.Agent.MQTT, sc.Agent.MQTT) {
+		events = append(events, MQTTCredsRotated)
+	}
+	if !reflect.DeepEqual(prev.Export, sc.Export) {
+		events = append(events, ExportChanged)
+	}
+	if !reflect.DeepEqual(prev.Agent.Heartbeat, sc.Agent.Heartbeat) {
+		events = append(events, HeartbeatChanged)
+	}
+	return events
+}
+
+// pollConfig issues a single long-poll request for cfg.ID, blocking on the
+// server side for up to wait for a change since version. It reports
+// notModified when the server answers 304 within the wait window.
+func pollConfig(ctx context.Context, cfg Config, client *http.Client, version string, wait time.Duration) (deviceConfig, string, bool, error) {
+	q := url.Values{}
+	q.Set("wait", wait.String())
+	q.Set("version", version)
+	reqURL := fmt.Sprintf("%s/%s?%s", cfg.URL, cfg.ID, q.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return deviceConfig{}, "", false, err
+	}
+	setBootstrapHeaders(req, cfg)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return deviceConfig{}, "", false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return deviceConfig{}, version, true, nil
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return deviceConfig{}, "", false, &statusError{status: resp.StatusCode, retryAfter: retryAfterFromHeader(resp.Header)}
+	}
+
+	dc, err := parseConfigResponse(cfg, resp)
+	if err != nil {
+		return deviceConfig{}, "", false, err
+	}
+	return dc, resp.Header.Get("ETag"), false, nil
+}